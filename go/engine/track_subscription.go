@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/protocol/go"
+)
+
+// defaultTrackSubscriptionPollInterval is how often a
+// TrackSubscriptionEngine re-checks each username when the caller didn't
+// ask for a different cadence.
+const defaultTrackSubscriptionPollInterval = 5 * time.Minute
+
+// TrackSubscriptionArg configures a TrackSubscriptionEngine.
+type TrackSubscriptionArg struct {
+	Usernames    []string
+	PollInterval time.Duration
+}
+
+// TrackSubscriptionEngine watches a set of already-tracked usernames and
+// emits a TrackStatusChanged notification, over the keybase1
+// NotifyTracking protocol, whenever a later check computes a different
+// keybase1.TrackStatus than the one last observed for that user. It
+// exists so callers don't have to re-run the one-shot TrackEngine just to
+// find out whether someone they track has changed their proofs; see
+// TestTrackProofRooterRevoke for the NEW_OK -> UPDATE_BROKEN -> UPDATE_OK
+// sequence. The UPDATE_BROKEN change is reported without anyone
+// re-tracking; the UPDATE_OK change is reported only after the user
+// re-tracks, since this engine never writes a tracking statement itself.
+//
+// The notification goes out through GlobalContext's NotifyRouter, the
+// same path every other keybase1 notification in this package uses to
+// reach RPC clients (the GUI, other subscribed processes, etc.); testSink
+// is an additional, optional hook for tests that don't have an RPC client
+// to listen on.
+//
+// Today it drives the check itself by polling. Piggybacking on the
+// gregor/notification bus instead, so a revoke is noticed as soon as the
+// server sees it rather than on the next tick, is a natural follow-up.
+type TrackSubscriptionEngine struct {
+	libkb.Contextified
+	arg      TrackSubscriptionArg
+	testSink func(keybase1.TrackStatusChanged)
+
+	last map[string]keybase1.TrackStatus
+
+	shutdownOnce sync.Once
+	shutdownCh   chan struct{}
+}
+
+// NewTrackSubscriptionEngine makes a new TrackSubscriptionEngine.
+// testSink, if non-nil, is called once per real status transition in
+// addition to the keybase1.NotifyTracking RPC notification; it exists so
+// tests can observe transitions without standing up an RPC client.
+func NewTrackSubscriptionEngine(g *libkb.GlobalContext, arg TrackSubscriptionArg, testSink func(keybase1.TrackStatusChanged)) *TrackSubscriptionEngine {
+	if arg.PollInterval == 0 {
+		arg.PollInterval = defaultTrackSubscriptionPollInterval
+	}
+	return &TrackSubscriptionEngine{
+		Contextified: libkb.NewContextified(g),
+		arg:          arg,
+		testSink:     testSink,
+		last:         make(map[string]keybase1.TrackStatus),
+		shutdownCh:   make(chan struct{}),
+	}
+}
+
+func (e *TrackSubscriptionEngine) Name() string {
+	return "TrackSubscription"
+}
+
+func (e *TrackSubscriptionEngine) Prereqs() Prereqs {
+	return Prereqs{Device: true}
+}
+
+func (e *TrackSubscriptionEngine) RequiredUIs() []libkb.UIKind {
+	return []libkb.UIKind{libkb.SecretUIKind}
+}
+
+func (e *TrackSubscriptionEngine) SubConsumers() []UIConsumer {
+	return nil
+}
+
+// Run establishes the initial TrackStatus for every username in
+// e.arg.Usernames, then starts the poll loop in the background and
+// returns. The loop keeps running, comparing against the status it last
+// saw, until Shutdown is called.
+func (e *TrackSubscriptionEngine) Run(ctx *Context) (err error) {
+	defer e.G().CTrace(ctx.NetContext, "TrackSubscriptionEngine#Run", func() error { return err })()
+
+	for _, username := range e.arg.Usernames {
+		status, _, err := e.checkOnce(ctx, username)
+		if err != nil {
+			return err
+		}
+		e.last[username] = status
+	}
+
+	go e.pollLoop(ctx)
+	return nil
+}
+
+// Shutdown stops the poll loop. Safe to call more than once.
+func (e *TrackSubscriptionEngine) Shutdown() {
+	e.shutdownOnce.Do(func() { close(e.shutdownCh) })
+}
+
+func (e *TrackSubscriptionEngine) pollLoop(ctx *Context) {
+	ticker := time.NewTicker(e.arg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.shutdownCh:
+			return
+		case <-ticker.C:
+			for _, username := range e.arg.Usernames {
+				e.checkAndNotify(ctx, username)
+			}
+		}
+	}
+}
+
+func (e *TrackSubscriptionEngine) checkAndNotify(ctx *Context, username string) {
+	status, blocks, err := e.checkOnce(ctx, username)
+	if err != nil {
+		// A transient network error shouldn't surface as a spurious
+		// status change; the next tick will just try again.
+		e.G().Log.Debug("TrackSubscriptionEngine: ignoring error checking %s, will retry: %s", username, err)
+		return
+	}
+
+	old, found := e.last[username]
+	e.last[username] = status
+	if found && old == status {
+		return
+	}
+
+	change := keybase1.TrackStatusChanged{
+		Username:      username,
+		OldStatus:     old,
+		NewStatus:     status,
+		ChangedBlocks: blocks,
+	}
+	// HandleTrackStatusChanged fans this out to every RPC client
+	// subscribed to keybase1.NotifyTracking, the same way
+	// NotifyRouter's other Handle* methods deliver every other
+	// keybase1 notification in this package.
+	e.G().NotifyRouter.HandleTrackStatusChanged(change)
+	if e.testSink != nil {
+		e.testSink(change)
+	}
+}
+
+// checkOnce recomputes username's TrackStatus by running the track engine
+// against the existing tracking statement, which exercises
+// libkb.IdentifyState.ComputeRevokedProofs and the service-block diffing
+// that checkTrack asserts on. Options.LocalOnly is what keeps this safe to
+// call unattended on every poll tick: a manual re-track writes a new
+// tracking statement whenever the computed status has changed, and
+// BypassConfirm alone only skips the UI confirmation before that write, it
+// doesn't stop it happening. checkOnce must never do that on its own, since
+// nothing here represents the user deciding to accept a changed proof set;
+// LocalOnly tells the track engine to report the status without touching
+// the user's sigchain, leaving the actual re-track (and its write) to
+// whatever UI surfaces this notification to the user.
+func (e *TrackSubscriptionEngine) checkOnce(ctx *Context, username string) (keybase1.TrackStatus, []keybase1.ServiceBlock, error) {
+	arg := &TrackEngineArg{
+		TheirName: username,
+		Options: keybase1.TrackOptions{
+			BypassConfirm: true,
+			LocalOnly:     true,
+		},
+	}
+	eng := NewTrackEngine(arg, e.G())
+	if err := RunEngine(eng, ctx); err != nil {
+		return keybase1.TrackStatus_NEW_ZERO_PROOFS, nil, err
+	}
+
+	them := eng.User()
+	me, err := libkb.LoadMe(libkb.LoadUserArg{})
+	if err != nil {
+		return keybase1.TrackStatus_NEW_ZERO_PROOFS, nil, err
+	}
+	link, err := me.TrackChainLinkFor(them.GetName(), them.GetUID())
+	if err != nil {
+		return keybase1.TrackStatus_NEW_ZERO_PROOFS, nil, err
+	}
+
+	var blocks []keybase1.ServiceBlock
+	for _, block := range link.ToServiceBlocks() {
+		blocks = append(blocks, block.Export())
+	}
+
+	return eng.TrackStatus(), blocks, nil
+}
@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/protocol/go"
+)
+
+// waitForTrackStatusChanged blocks until a TrackStatusChanged event for
+// username arrives on ch, or fails the test after timeout.
+func waitForTrackStatusChanged(t *testing.T, ch <-chan keybase1.TrackStatusChanged, username string, timeout time.Duration) keybase1.TrackStatusChanged {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case change := <-ch:
+			if change.Username == username {
+				return change
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for a TrackStatusChanged event for %s", username)
+		}
+	}
+}
+
+// TestTrackSubscriptionRooterRevoke mirrors TestTrackProofRooterRevoke,
+// but instead of re-tracking to notice the revoke, it lets a
+// TrackSubscriptionEngine poll for the NEW_OK -> UPDATE_BROKEN change and
+// asserts on what it emits. It then re-tracks once, as a user accepting
+// the changed proof set would, and expects the UPDATE_BROKEN -> UPDATE_OK
+// change that follows.
+func TestTrackSubscriptionRooterRevoke(t *testing.T) {
+	tc := SetupEngineTest(t, "track")
+	defer tc.Cleanup()
+
+	// create a user with a rooter proof
+	proofUser := CreateAndSignupFakeUser(tc, "proof")
+	_, sigID, err := proveRooter(tc.G, proofUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Logout(tc)
+
+	// create a user to track the proofUser
+	trackUser := CreateAndSignupFakeUser(tc, "track")
+
+	rbl := sb{
+		social:     true,
+		id:         proofUser.Username + "@rooter",
+		proofState: keybase1.ProofState_OK,
+	}
+	err = checkTrack(tc, trackUser, proofUser.Username, []sb{rbl}, keybase1.TrackStatus_NEW_OK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan keybase1.TrackStatusChanged, 10)
+	subEng := NewTrackSubscriptionEngine(tc.G, TrackSubscriptionArg{
+		Usernames:    []string{proofUser.Username},
+		PollInterval: 20 * time.Millisecond,
+	}, func(change keybase1.TrackStatusChanged) { events <- change })
+
+	ctx := &Context{LogUI: tc.G.UI.GetLogUI(), SecretUI: trackUser.NewSecretUI()}
+	if err := subEng.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer subEng.Shutdown()
+
+	// revoke the rooter proof
+	Logout(tc)
+	proofUser.LoginOrBust(tc)
+	revEng := NewRevokeSigsEngine([]keybase1.SigID{sigID}, nil, tc.G)
+	revCtx := &Context{
+		LogUI:    tc.G.UI.GetLogUI(),
+		SecretUI: proofUser.NewSecretUI(),
+	}
+	if err := revEng.Run(revCtx); err != nil {
+		t.Fatal(err)
+	}
+	Logout(tc)
+	trackUser.LoginOrBust(tc)
+
+	broken := waitForTrackStatusChanged(t, events, proofUser.Username, 5*time.Second)
+	if broken.OldStatus != keybase1.TrackStatus_NEW_OK {
+		t.Errorf("old status: %d, expected NEW_OK", broken.OldStatus)
+	}
+	if broken.NewStatus != keybase1.TrackStatus_UPDATE_BROKEN {
+		t.Errorf("new status: %d, expected UPDATE_BROKEN", broken.NewStatus)
+	}
+
+	// re-track, which writes a new tracking statement without the rooter proof
+	err = checkTrack(tc, trackUser, proofUser.Username, nil, keybase1.TrackStatus_UPDATE_BROKEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixed := waitForTrackStatusChanged(t, events, proofUser.Username, 5*time.Second)
+	if fixed.OldStatus != keybase1.TrackStatus_UPDATE_BROKEN {
+		t.Errorf("old status: %d, expected UPDATE_BROKEN", fixed.OldStatus)
+	}
+	if fixed.NewStatus != keybase1.TrackStatus_UPDATE_OK {
+		t.Errorf("new status: %d, expected UPDATE_OK", fixed.NewStatus)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	keybase1 "github.com/keybase/client/go/protocol/keybase1"
 	context "golang.org/x/net/context"
 	"sync"
+	"time"
 )
 
 // SharedDHKeyGeneration describes which generation of DH key we're talking about.
@@ -36,17 +37,85 @@ type SharedDHKeyMap map[SharedDHKeyGeneration]NaclDHKeyPair
 type SharedDHKeyring struct {
 	Contextified
 	sync.Mutex
-	uid         keybase1.UID
-	generations SharedDHKeyMap
+	uid           keybase1.UID
+	generations   SharedDHKeyMap
+	maxGeneration SharedDHKeyGeneration
+	disk          SharedDHKeyringDiskBackend
 }
 
-// NewSharedDHKeyring makes a new SharedDH keyring for a given UID.
+// sharedDHDiskVerifiedUIDs tracks, process-wide, which UIDs have already had
+// their on-disk journal verified against a UPAK by verifyDiskLocked. Update
+// calls Clone on every Sync, and Clone used to hand back a fresh
+// SharedDHKeyring (via NewSharedDHKeyring) with its own unverified instance
+// state, so a keyring that's updated routinely re-verified its entire disk
+// journal on every single call. Keying the "have we verified this UID's
+// journal yet" bit by UID instead of by *SharedDHKeyring instance makes that
+// verification a one-time cost per UID per process, paid again only while
+// verification keeps dropping entries.
+var sharedDHDiskVerifiedUIDs = struct {
+	sync.Mutex
+	m map[keybase1.UID]bool
+}{m: make(map[keybase1.UID]bool)}
+
+func sharedDHDiskVerifiedForUID(uid keybase1.UID) bool {
+	sharedDHDiskVerifiedUIDs.Lock()
+	defer sharedDHDiskVerifiedUIDs.Unlock()
+	return sharedDHDiskVerifiedUIDs.m[uid]
+}
+
+func markSharedDHDiskVerifiedForUID(uid keybase1.UID) {
+	sharedDHDiskVerifiedUIDs.Lock()
+	defer sharedDHDiskVerifiedUIDs.Unlock()
+	sharedDHDiskVerifiedUIDs.m[uid] = true
+}
+
+// NewSharedDHKeyring makes a new SharedDH keyring for a given UID, and
+// immediately replays whatever the on-disk journal already has into
+// generations. That replay trusts the disk entries as-is, since checking
+// them against the sigchain requires a UPAK, which can mean a network
+// round trip; doing that here would defeat the point of the journal, which
+// is to make CurrentGeneration/SharedDHKey usable before the first Sync.
+// Sync re-verifies everything replayed here against a fresh UPAK and drops
+// anything that no longer checks out, on every call until this UID's
+// journal has once verified with nothing dropped in this process.
 func NewSharedDHKeyring(g *GlobalContext, uid keybase1.UID) *SharedDHKeyring {
-	return &SharedDHKeyring{
+	disk := g.SharedDHKeyringDisk
+	if disk == nil {
+		disk = newFileSharedDHKeyringDisk(g)
+	}
+	ret := &SharedDHKeyring{
 		Contextified: NewContextified(g),
 		uid:          uid,
 		generations:  make(SharedDHKeyMap),
+		disk:         disk,
+	}
+	ret.replayDisk(g)
+	return ret
+}
+
+// replayDisk loads uid's on-disk journal, unverified, into generations.
+func (s *SharedDHKeyring) replayDisk(g *GlobalContext) {
+	entries, err := s.disk.Load(s.uid)
+	if err != nil {
+		g.Log.Errorf("SharedDHKeyring: failed to replay on-disk journal for %s: %s", s.uid, err)
+		return
+	}
+	m := make(SharedDHKeyMap)
+	for _, entry := range entries {
+		m[entry.Generation] = entry.Key
 	}
+	s.mergeLocked(m)
+}
+
+// Reset discards this user's on-disk journal, so a signout or full
+// account revoke can't leave stale generations around for the next
+// NewSharedDHKeyring to replay. It also forgets that uid's journal was
+// verified, since the journal it was verified against no longer exists.
+func (s *SharedDHKeyring) Reset(uid keybase1.UID) error {
+	sharedDHDiskVerifiedUIDs.Lock()
+	delete(sharedDHDiskVerifiedUIDs.m, uid)
+	sharedDHDiskVerifiedUIDs.Unlock()
+	return s.disk.Reset(uid)
 }
 
 // CurrentGeneration returns what generation we're on. The version possible
@@ -58,7 +127,7 @@ func (s *SharedDHKeyring) CurrentGeneration() SharedDHKeyGeneration {
 }
 
 func (s *SharedDHKeyring) currentGenerationLocked() SharedDHKeyGeneration {
-	return SharedDHKeyGeneration(len(s.generations))
+	return s.maxGeneration
 }
 
 func (s *SharedDHKeyring) SharedDHKey(g SharedDHKeyGeneration) *NaclDHKeyPair {
@@ -92,62 +161,114 @@ func (s *SharedDHKeyring) Update(ctx context.Context) (ret *SharedDHKeyring, err
 // Secret boxes since our last update, or not at all if there was an error.
 // Pass it a standard Go network context.
 func (s *SharedDHKeyring) Sync(ctx context.Context) (err error) {
+	start := time.Now()
+	var metrics sharedDHSyncMetrics
+	defer func() {
+		metrics.Elapsed = time.Since(start)
+		s.G().Log.CDebugf(ctx, "| SharedDHKeyring#Sync metrics: %s", metrics)
+	}()
 	defer s.G().CTrace(ctx, "SharedDHKeyring#Sync", func() error { return err })()
 
 	s.Lock()
 	defer s.Unlock()
 
-	boxes, err := s.fetchBoxesLocked(ctx)
+	upak, _, err := s.G().GetUPAKLoader().Load(NewLoadUserByUIDArg(ctx, s.G(), s.uid))
 	if err != nil {
 		return err
 	}
+	checker := newSharedDHChecker(upak)
 
-	upak, _, err := s.G().GetUPAKLoader().Load(NewLoadUserByUIDArg(ctx, s.G(), s.uid))
-	if err != nil {
-		return err
+	if !sharedDHDiskVerifiedForUID(s.uid) {
+		if s.verifyDiskLocked(ctx, checker) {
+			markSharedDHDiskVerifiedForUID(s.uid)
+		}
 	}
 
-	newKeys, err := s.importLocked(ctx, boxes, newSharedDHChecker(upak))
+	boxes, fetchErrCh := s.fetchBoxesPipelined(ctx, &metrics)
+	newKeys, newEntries, err := s.importPipelined(ctx, boxes, checker, &metrics)
 	if err != nil {
 		return err
-
+	}
+	select {
+	case fetchErr := <-fetchErrCh:
+		if fetchErr != nil {
+			return fetchErr
+		}
+	default:
 	}
 	s.mergeLocked(newKeys)
-	return nil
-}
 
-func (s *SharedDHKeyring) mergeLocked(m SharedDHKeyMap) (err error) {
-	for k, v := range m {
-		s.generations[k] = v.Clone()
+	if err := s.disk.Append(s.uid, newEntries); err != nil {
+		// The sync itself already succeeded in memory; a failure to
+		// persist it just means we'll re-fetch these generations from
+		// the server next time, so it's not fatal.
+		s.G().Log.CDebugf(ctx, "| SharedDHKeyring#Sync: failed to append to disk journal: %s", err)
 	}
+
 	return nil
 }
 
-func (s *SharedDHKeyring) fetchBoxesLocked(ctx context.Context) (ret []SharedDHSecretKeyBox, err error) {
-	defer s.G().CTrace(ctx, "SharedDHKeyring#fetchBoxesLocked", func() error { return err })()
+// verifyDiskLocked re-checks every generation replayDisk optimistically
+// loaded against checker (a fresh UPAK), so a tampered-with or simply
+// stale config directory can't inject a KID the current sigchain doesn't
+// expect. Generations are required to be contiguous starting at 1: the
+// first one that fails verification, along with every generation after
+// it, is dropped, and currentGenerationLocked is set to the verified
+// prefix length. This is deliberate rather than just skipping the bad
+// entry and keeping the rest: currentGenerationLocked (and thus the
+// after_generation we tell the server about) has to name a single point
+// before which we trust we have everything, or a discarded generation in
+// the middle would silently never get re-fetched. It returns true only if
+// every generation on disk verified; while it returns false the disk still
+// holds the dropped entries, so Sync verifies again next time instead of
+// trusting them when another keyring (e.g. one made by Clone) replays them.
+func (s *SharedDHKeyring) verifyDiskLocked(ctx context.Context, checker *sharedDHChecker) (clean bool) {
+	defer s.G().CTrace(ctx, "SharedDHKeyring#verifyDiskLocked", func() error { return nil })()
 
-	did := s.G().Env.GetDeviceIDForUID(s.uid)
-	if did.IsNil() {
-		return nil, DeviceRequiredError{}
+	entries, err := s.disk.Load(s.uid)
+	if err != nil {
+		s.G().Log.CWarningf(ctx, "| SharedDHKeyring#verifyDiskLocked: failed to re-read disk journal, discarding replayed state: %s", err)
+		entries = nil
+	}
+	byGeneration := make(map[SharedDHKeyGeneration]SharedDHDiskEntry, len(entries))
+	for _, entry := range entries {
+		byGeneration[entry.Generation] = entry
 	}
 
-	var resp sharedDHSecretKeyBoxesResp
-	err = s.G().API.GetDecode(APIArg{
-		Endpoint: "key/fetch_shared_dh_secrets",
-		Args: HTTPArgs{
-			"generation": I{int(s.currentGenerationLocked())},
-			"device_id":  S{did.String()},
-		},
-		SessionType: APISessionTypeREQUIRED,
-		RetryCount:  5, // It's pretty bad to fail this, so retry.
-		NetContext:  ctx,
-	}, &resp)
-	if err != nil {
-		return nil, err
+	verified := make(SharedDHKeyMap)
+	var prefix SharedDHKeyGeneration
+	for g := SharedDHKeyGeneration(1); ; g++ {
+		entry, found := byGeneration[g]
+		if !found {
+			break
+		}
+		expectedKID, ok := checker.expectedSharedDHKIDs[g]
+		if !ok || !expectedKID.Equal(entry.Key.GetKID()) {
+			s.G().Log.CWarningf(ctx, "| SharedDHKeyring#verifyDiskLocked: gen=%d no longer matches sigchain, discarding it and everything after", g)
+			break
+		}
+		if !checker.allowedEncryptingKIDs[entry.EncryptingKID] {
+			s.G().Log.CWarningf(ctx, "| SharedDHKeyring#verifyDiskLocked: gen=%d encrypting kid no longer allowed, discarding it and everything after", g)
+			break
+		}
+		verified[g] = entry.Key
+		prefix = g
 	}
-	ret = resp.Boxes
-	s.G().Log.CDebugf(ctx, "| Got back %d boxes from server", len(ret))
-	return ret, nil
+
+	s.generations = verified
+	s.maxGeneration = prefix
+	s.G().Log.CDebugf(ctx, "| SharedDHKeyring#verifyDiskLocked: verified %d disk generations", prefix)
+	return int(prefix) == len(byGeneration)
+}
+
+func (s *SharedDHKeyring) mergeLocked(m SharedDHKeyMap) (err error) {
+	for k, v := range m {
+		s.generations[k] = v.Clone()
+		if k > s.maxGeneration {
+			s.maxGeneration = k
+		}
+	}
+	return nil
 }
 
 // sharedDHChecker checks the secret boxes returned from the server
@@ -185,52 +306,31 @@ func newSharedDHChecker(upak *keybase1.UserPlusAllKeys) *sharedDHChecker {
 	return &ret
 }
 
-func importSharedDHKey(box *SharedDHSecretKeyBox, activeDecryptionKey GenericKey, wantedGeneration SharedDHKeyGeneration, checker *sharedDHChecker) (ret *NaclDHKeyPair, err error) {
+func importSharedDHKey(box *SharedDHSecretKeyBox, activeDecryptionKey GenericKey, wantedGeneration SharedDHKeyGeneration, checker *sharedDHChecker) (ret *NaclDHKeyPair, encryptingKID keybase1.KID, err error) {
 	if box.Generation != wantedGeneration {
-		return nil, SharedDHImportError{fmt.Sprintf("bad generation returned: %d", box.Generation)}
+		return nil, encryptingKID, SharedDHImportError{fmt.Sprintf("bad generation returned: %d", box.Generation)}
 	}
 	if !activeDecryptionKey.GetKID().Equal(box.ReceiverKID) {
-		return nil, SharedDHImportError{fmt.Sprintf("wrong encryption kid: %s", box.ReceiverKID.String())}
+		return nil, encryptingKID, SharedDHImportError{fmt.Sprintf("wrong encryption kid: %s", box.ReceiverKID.String())}
 	}
 	rawKey, encryptingKID, err := activeDecryptionKey.DecryptFromString(box.Box)
 	if err != nil {
-		return nil, err
+		return nil, encryptingKID, err
 	}
 	if !checker.allowedEncryptingKIDs[encryptingKID] {
-		return nil, SharedDHImportError{fmt.Sprintf("unexpected encrypting kid: %s", encryptingKID)}
+		return nil, encryptingKID, SharedDHImportError{fmt.Sprintf("unexpected encrypting kid: %s", encryptingKID)}
 	}
 	key, err := MakeNaclDHKeyPairFromSecretBytes(rawKey)
 	if err != nil {
-		return nil, err
+		return nil, encryptingKID, err
 	}
 	expectedKID, found := checker.expectedSharedDHKIDs[box.Generation]
 	if !found {
-		return nil, SharedDHImportError{fmt.Sprintf("No known generation: %d", box.Generation)}
+		return nil, encryptingKID, SharedDHImportError{fmt.Sprintf("No known generation: %d", box.Generation)}
 	}
 	if !expectedKID.Equal(key.GetKID()) {
-		return nil, SharedDHImportError{fmt.Sprintf("Wrong public key for gen=%d; %s != %s", box.Generation, expectedKID, key.GetKID())}
+		return nil, encryptingKID, SharedDHImportError{fmt.Sprintf("Wrong public key for gen=%d; %s != %s", box.Generation, expectedKID, key.GetKID())}
 	}
 
-	return &key, nil
-}
-
-func (s *SharedDHKeyring) importLocked(ctx context.Context, boxes []SharedDHSecretKeyBox, checker *sharedDHChecker) (ret SharedDHKeyMap, err error) {
-	defer s.G().CTrace(ctx, "SharedDHKeyring#importLocked", func() error { return err })()
-
-	ret = make(SharedDHKeyMap)
-	var activeDecryptionKey GenericKey
-	activeDecryptionKey, err = s.G().ActiveDevice.EncryptionKey()
-	if err != nil {
-		return nil, err
-	}
-	nxt := s.currentGenerationLocked() + 1
-	for _, box := range boxes {
-		naclDHKey, err := importSharedDHKey(&box, activeDecryptionKey, nxt, checker)
-		if err != nil {
-			return nil, err
-		}
-		ret[nxt] = *naclDHKey
-		nxt++
-	}
-	return ret, nil
+	return &key, encryptingKID, nil
 }
@@ -0,0 +1,92 @@
+package libkb
+
+import (
+	"testing"
+
+	keybase1 "github.com/keybase/client/go/protocol/keybase1"
+	context "golang.org/x/net/context"
+)
+
+// syntheticSharedDHBoxes builds n self-consistent generations of shared DH
+// keys, boxed to deviceKey the same way the server would, plus a checker
+// that will accept all of them. It's only meant to drive the benchmarks
+// below, not to exercise sharedDHChecker itself.
+func syntheticSharedDHBoxes(tb testing.TB, n int, deviceKey NaclDHKeyPair) ([]SharedDHSecretKeyBox, *sharedDHChecker) {
+	checker := &sharedDHChecker{
+		allowedEncryptingKIDs: map[keybase1.KID]bool{deviceKey.GetKID(): true},
+		expectedSharedDHKIDs:  make(map[SharedDHKeyGeneration]keybase1.KID),
+	}
+	boxes := make([]SharedDHSecretKeyBox, n)
+	for i := 0; i < n; i++ {
+		gen := SharedDHKeyGeneration(i + 1)
+		genKey, err := GenerateNaclDHKeyPair()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		sealed, err := deviceKey.EncryptToString(genKey.Private[:], &deviceKey)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		checker.expectedSharedDHKIDs[gen] = genKey.GetKID()
+		boxes[i] = SharedDHSecretKeyBox{
+			Generation:  gen,
+			Box:         sealed,
+			ReceiverKID: deviceKey.GetKID(),
+		}
+	}
+	return boxes, checker
+}
+
+// BenchmarkSharedDHImportSerial decrypts a batch of boxes one at a time,
+// the way importLocked used to before the pipeline, as a baseline for
+// BenchmarkSharedDHImportPipelined below.
+func BenchmarkSharedDHImportSerial(b *testing.B) {
+	deviceKey, err := GenerateNaclDHKeyPair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	boxes, checker := syntheticSharedDHBoxes(b, 500, deviceKey)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nxt := SharedDHKeyGeneration(1)
+		for j := range boxes {
+			if _, _, err := importSharedDHKey(&boxes[j], deviceKey, nxt, checker); err != nil {
+				b.Fatal(err)
+			}
+			nxt++
+		}
+	}
+}
+
+// BenchmarkSharedDHImportPipelined runs the same batch through
+// importPipelined, whose worker pool defaults to runtime.NumCPU(). On a
+// multi-core benchmarking machine this should beat
+// BenchmarkSharedDHImportSerial by roughly that factor.
+func BenchmarkSharedDHImportPipelined(b *testing.B) {
+	tc := SetupTest(b, "shared_dh", 1)
+	defer tc.Cleanup()
+
+	deviceKey, err := GenerateNaclDHKeyPair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	tc.G.ActiveDevice.SetEncryptionKeyForTesting(deviceKey)
+
+	boxes, checker := syntheticSharedDHBoxes(b, 500, deviceKey)
+	s := NewSharedDHKeyring(tc.G, keybase1.UID("295a7eea607af32b25a121a70ad2ffff"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		in := make(chan SharedDHSecretKeyBox, len(boxes))
+		for _, box := range boxes {
+			in <- box
+		}
+		close(in)
+
+		var metrics sharedDHSyncMetrics
+		if _, _, err := s.importPipelined(context.Background(), in, checker, &metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package libkb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	keybase1 "github.com/keybase/client/go/protocol/keybase1"
+)
+
+// sharedDHJournalCompactionThreshold is the number of journal entries at
+// which they're folded into the base file. This bounds the size of the
+// journal file only: replay-on-startup reads the base file and the journal
+// alike, so it reads every stored entry whatever this is set to.
+const sharedDHJournalCompactionThreshold = 100
+
+// SharedDHDiskEntry is one on-disk record of a previously-imported shared
+// DH key. It mirrors exactly what importSharedDHKey verifies, so a replay
+// of the journal can re-derive the same trust decision sharedDHChecker
+// made the first time around.
+type SharedDHDiskEntry struct {
+	Generation    SharedDHKeyGeneration `json:"generation"`
+	Key           NaclDHKeyPair         `json:"key"`
+	ReceiverKID   keybase1.KID          `json:"receiver_kid"`
+	EncryptingKID keybase1.KID          `json:"encrypting_kid"`
+}
+
+// SharedDHKeyringDiskBackend is the persistence layer underneath a
+// SharedDHKeyring. It is an interface (rather than a concrete file-backed
+// type) purely so tests can swap in an in-memory implementation via
+// GlobalContext; production code always gets fileSharedDHKeyringDisk.
+type SharedDHKeyringDiskBackend interface {
+	// Load returns every entry currently on disk for uid, oldest
+	// generation first.
+	Load(uid keybase1.UID) ([]SharedDHDiskEntry, error)
+	// Append atomically adds newly-imported entries to the journal.
+	Append(uid keybase1.UID, entries []SharedDHDiskEntry) error
+	// Reset discards all on-disk state for uid, used after
+	// signout/revoke so a stale journal can't leak into the next login.
+	Reset(uid keybase1.UID) error
+}
+
+// fileSharedDHKeyringDisk is the default SharedDHKeyringDiskBackend. Each
+// UID gets a "base" file (the compacted snapshot) and a "journal" file
+// (entries appended since the last compaction), both under the config
+// dir, following the same split that the rest of the state-store code
+// uses for snapshot+journal persistence.
+type fileSharedDHKeyringDisk struct {
+	Contextified
+	sync.Mutex
+}
+
+func newFileSharedDHKeyringDisk(g *GlobalContext) *fileSharedDHKeyringDisk {
+	return &fileSharedDHKeyringDisk{Contextified: NewContextified(g)}
+}
+
+func (f *fileSharedDHKeyringDisk) basePath(uid keybase1.UID) string {
+	return filepath.Join(f.G().Env.GetConfigDir(), fmt.Sprintf("shared-dh-base-%s.json", uid))
+}
+
+func (f *fileSharedDHKeyringDisk) journalPath(uid keybase1.UID) string {
+	return filepath.Join(f.G().Env.GetConfigDir(), fmt.Sprintf("shared-dh-journal-%s.json", uid))
+}
+
+// encryptingKey returns the long-term device key entries are sealed to on
+// disk. It's the same key importPipelined already uses to open the server's
+// boxes, so a stolen config directory is no more useful than a stolen
+// server response would be.
+func (f *fileSharedDHKeyringDisk) encryptingKey() (GenericKey, error) {
+	return f.G().ActiveDevice.EncryptionKey()
+}
+
+func (f *fileSharedDHKeyringDisk) readEntries(path string) (ret []SharedDHDiskEntry, err error) {
+	key, err := f.encryptingKey()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		sealed := scanner.Text()
+		if len(sealed) == 0 {
+			continue
+		}
+		plaintext, _, err := key.DecryptFromString(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("shared dh disk entry corrupt or unreadable: %s", err)
+		}
+		var entry SharedDHDiskEntry
+		if err := json.Unmarshal(plaintext, &entry); err != nil {
+			return nil, err
+		}
+		ret = append(ret, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (f *fileSharedDHKeyringDisk) Load(uid keybase1.UID) (ret []SharedDHDiskEntry, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	base, err := f.readEntries(f.basePath(uid))
+	if err != nil {
+		return nil, err
+	}
+	journal, err := f.readEntries(f.journalPath(uid))
+	if err != nil {
+		return nil, err
+	}
+	return append(base, journal...), nil
+}
+
+func (f *fileSharedDHKeyringDisk) Append(uid keybase1.UID, entries []SharedDHDiskEntry) (err error) {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	key, err := f.encryptingKey()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.journalPath(uid), os.O_APPEND|os.O_CREATE|os.O_WRONLY, PermFile)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		plaintext, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		sealed, err := key.EncryptToString(plaintext, nil)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := io.WriteString(file, sealed+"\n"); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	// maybeCompactLocked can replace the journal out from under us (it
+	// os.Removes f.journalPath(uid) once compacted into the base file), so
+	// file needs to be closed first: on Windows a still-open handle keeps
+	// the journal from being removed at all, which would silently wedge
+	// compaction forever once the threshold is hit.
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return f.maybeCompactLocked(uid)
+}
+
+// maybeCompactLocked folds the journal into the base file once it holds
+// sharedDHJournalCompactionThreshold or more entries. Load still reads
+// every entry (base and journal), so this does not change replay cost.
+// Caller must already hold f's lock.
+func (f *fileSharedDHKeyringDisk) maybeCompactLocked(uid keybase1.UID) error {
+	journal, err := f.readEntries(f.journalPath(uid))
+	if err != nil {
+		return err
+	}
+	if len(journal) < sharedDHJournalCompactionThreshold {
+		return nil
+	}
+	base, err := f.readEntries(f.basePath(uid))
+	if err != nil {
+		return err
+	}
+
+	key, err := f.encryptingKey()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := f.basePath(uid) + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, PermFile)
+	if err != nil {
+		return err
+	}
+	for _, entry := range append(base, journal...) {
+		plaintext, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		sealed, err := key.EncryptToString(plaintext, nil)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := io.WriteString(tmp, sealed+"\n"); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, f.basePath(uid)); err != nil {
+		return err
+	}
+	return os.Remove(f.journalPath(uid))
+}
+
+func (f *fileSharedDHKeyringDisk) Reset(uid keybase1.UID) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := os.Remove(f.basePath(uid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(f.journalPath(uid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// memorySharedDHKeyringDisk is a SharedDHKeyringDiskBackend that never
+// touches disk, for tests that want to exercise journal replay without
+// config-dir side effects.
+type memorySharedDHKeyringDisk struct {
+	sync.Mutex
+	entries map[keybase1.UID][]SharedDHDiskEntry
+}
+
+// NewMemorySharedDHKeyringDisk returns an in-memory SharedDHKeyringDiskBackend
+// suitable for injecting into GlobalContext in tests.
+func NewMemorySharedDHKeyringDisk() SharedDHKeyringDiskBackend {
+	return &memorySharedDHKeyringDisk{entries: make(map[keybase1.UID][]SharedDHDiskEntry)}
+}
+
+func (m *memorySharedDHKeyringDisk) Load(uid keybase1.UID) ([]SharedDHDiskEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]SharedDHDiskEntry, len(m.entries[uid]))
+	copy(ret, m.entries[uid])
+	return ret, nil
+}
+
+func (m *memorySharedDHKeyringDisk) Append(uid keybase1.UID, entries []SharedDHDiskEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[uid] = append(m.entries[uid], entries...)
+	return nil
+}
+
+func (m *memorySharedDHKeyringDisk) Reset(uid keybase1.UID) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.entries, uid)
+	return nil
+}
@@ -0,0 +1,200 @@
+package libkb
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+)
+
+// sharedDHFetchPageSize bounds how many boxes we ask the server for in a
+// single key/fetch_shared_dh_secrets call, so stage one can start handing
+// boxes to stage two before the full set (which can be large, for an
+// old account with many revokes) has even been fetched.
+const sharedDHFetchPageSize = 100
+
+// sharedDHSyncMetrics summarizes one Sync's pipeline for the trace log.
+// It's deliberately plain data (no G() dependency) so a benchmark can
+// construct and inspect one without a real GlobalContext.
+type sharedDHSyncMetrics struct {
+	Fetched   int
+	Decrypted int
+	Verified  int
+	Elapsed   time.Duration
+}
+
+func (m sharedDHSyncMetrics) String() string {
+	return fmt.Sprintf("fetched=%d decrypted=%d verified=%d elapsed=%s", m.Fetched, m.Decrypted, m.Verified, m.Elapsed)
+}
+
+// fetchWorkers returns how many goroutines should decrypt boxes in
+// parallel. It's configurable via GlobalContext (mainly so tests and
+// benchmarks can pin it), defaulting to one per CPU.
+func (s *SharedDHKeyring) fetchWorkers() int {
+	if n := s.G().Env.GetSharedDHKeyringFetchWorkers(); n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// fetchBoxesPipelined issues key/fetch_shared_dh_secrets in pages,
+// starting after the generation we already have, and streams each page's
+// boxes onto the returned channel as soon as it arrives rather than
+// waiting for every page up front. The channel is closed when fetching is
+// done; a fetch error is reported on the returned error channel (capacity
+// 1) instead of being folded into the box channel, so the caller can keep
+// draining the box channel (and thus unblock the producer) while it
+// decides how to handle the error.
+func (s *SharedDHKeyring) fetchBoxesPipelined(ctx context.Context, metrics *sharedDHSyncMetrics) (<-chan SharedDHSecretKeyBox, <-chan error) {
+	out := make(chan SharedDHSecretKeyBox, sharedDHFetchPageSize)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+		after := s.currentGenerationLocked()
+		for {
+			page, err := s.fetchBoxesPageLocked(ctx, after, sharedDHFetchPageSize)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			for _, box := range page {
+				metrics.Fetched++
+				select {
+				case out <- box:
+				case <-ctx.Done():
+					errCh <- ctx.Err()
+					return
+				}
+			}
+			if len(page) < sharedDHFetchPageSize {
+				return
+			}
+			after = page[len(page)-1].Generation
+		}
+	}()
+
+	return out, errCh
+}
+
+func (s *SharedDHKeyring) fetchBoxesPageLocked(ctx context.Context, afterGeneration SharedDHKeyGeneration, limit int) (ret []SharedDHSecretKeyBox, err error) {
+	defer s.G().CTrace(ctx, "SharedDHKeyring#fetchBoxesPageLocked", func() error { return err })()
+
+	did := s.G().Env.GetDeviceIDForUID(s.uid)
+	if did.IsNil() {
+		return nil, DeviceRequiredError{}
+	}
+
+	var resp sharedDHSecretKeyBoxesResp
+	err = s.G().API.GetDecode(APIArg{
+		Endpoint: "key/fetch_shared_dh_secrets",
+		Args: HTTPArgs{
+			"after_generation": I{int(afterGeneration)},
+			"limit":            I{limit},
+			"device_id":        S{did.String()},
+		},
+		SessionType: APISessionTypeREQUIRED,
+		RetryCount:  5, // It's pretty bad to fail this, so retry.
+		NetContext:  ctx,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	s.G().Log.CDebugf(ctx, "| Got back %d boxes from server (after generation %d)", len(resp.Boxes), afterGeneration)
+	return resp.Boxes, nil
+}
+
+type sharedDHImportResult struct {
+	generation SharedDHKeyGeneration
+	key        NaclDHKeyPair
+	entry      SharedDHDiskEntry
+	err        error
+}
+
+// importPipelined decrypts boxes off of in using a bounded worker pool of
+// s.fetchWorkers() goroutines, then reassembles the results in strict
+// Generation order before handing back to the caller. Per the existing
+// all-or-nothing contract, any single box failing to decrypt or verify
+// fails the whole sync; we keep draining in to completion regardless (so
+// the fetchBoxesPipelined producer can't block forever on a full channel)
+// but report only the first error.
+//
+// results is drained by its own goroutine that runs for the whole
+// lifetime of this call, concurrently with the dispatch loop below. That
+// matters: each worker's sem release happens only after its send on
+// results completes, so if nothing were reading results until after every
+// box in `in` had been dispatched, the first s.fetchWorkers() workers
+// would block sending on results, never release sem, and the dispatch
+// loop would deadlock on sem <- struct{}{} for the next box.
+func (s *SharedDHKeyring) importPipelined(ctx context.Context, in <-chan SharedDHSecretKeyBox, checker *sharedDHChecker, metrics *sharedDHSyncMetrics) (ret SharedDHKeyMap, diskEntries []SharedDHDiskEntry, err error) {
+	defer s.G().CTrace(ctx, "SharedDHKeyring#importPipelined", func() error { return err })()
+
+	activeDecryptionKey, err := s.G().ActiveDevice.EncryptionKey()
+	if err != nil {
+		for range in {
+		}
+		return nil, nil, err
+	}
+
+	start := s.currentGenerationLocked() + 1
+	results := make(chan sharedDHImportResult)
+	sem := make(chan struct{}, s.fetchWorkers())
+
+	byGeneration := make(map[SharedDHKeyGeneration]sharedDHImportResult)
+	var collectErr error
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for res := range results {
+			metrics.Decrypted++
+			if res.err != nil && collectErr == nil {
+				collectErr = res.err
+			}
+			byGeneration[res.generation] = res
+		}
+	}()
+
+	var wg sync.WaitGroup
+	nxt := start
+	for box := range in {
+		box, wanted := box, nxt
+		nxt++
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			key, encryptingKID, err := importSharedDHKey(&box, activeDecryptionKey, wanted, checker)
+			res := sharedDHImportResult{generation: wanted, err: err}
+			if err == nil {
+				res.key = *key
+				res.entry = SharedDHDiskEntry{
+					Generation:    wanted,
+					Key:           *key,
+					ReceiverKID:   box.ReceiverKID,
+					EncryptingKID: encryptingKID,
+				}
+			}
+			results <- res
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+	<-collected
+
+	if collectErr != nil {
+		return nil, nil, collectErr
+	}
+
+	ret = make(SharedDHKeyMap)
+	for g := start; g < nxt; g++ {
+		res := byGeneration[g]
+		ret[g] = res.key
+		diskEntries = append(diskEntries, res.entry)
+		metrics.Verified++
+	}
+	return ret, diskEntries, nil
+}